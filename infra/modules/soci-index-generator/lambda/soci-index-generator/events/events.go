@@ -0,0 +1,28 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package events defines the shapes of the EventBridge events that this
+// Lambda is invoked with.
+package events
+
+// ECRImageActionEvent is the EventBridge event emitted by Amazon ECR when an
+// image is pushed to, or scanned in, a repository.
+type ECRImageActionEvent struct {
+	Version    string                    `json:"version"`
+	Id         string                    `json:"id"`
+	DetailType string                    `json:"detail-type"`
+	Source     string                    `json:"source"`
+	Account    string                    `json:"account"`
+	Time       string                    `json:"time"`
+	Region     string                    `json:"region"`
+	Detail     ECRImageActionEventDetail `json:"detail"`
+}
+
+// ECRImageActionEventDetail is the "detail" payload of an ECRImageActionEvent.
+type ECRImageActionEventDetail struct {
+	ActionType     string `json:"action-type"`
+	Result         string `json:"result"`
+	RepositoryName string `json:"repository-name"`
+	ImageDigest    string `json:"image-digest"`
+	ImageTag       string `json:"image-tag"`
+}
@@ -0,0 +1,212 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Command soci-index-generator is the Lambda handler invoked by the "ECR
+// Image Action" EventBridge rule on every image push. It validates that the
+// pushed image is a manifest the SOCI snapshotter understands, builds a SOCI
+// index for it, and pushes the index back to the same repository.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/events"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/writer"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+const (
+	respSkippedValidation   = "Exited early due to manifest validation error"
+	respSkippedByAnnotation = "Skipped by annotation policy"
+	respSuccess             = "Successfully built and pushed SOCI index"
+
+	// defaultPlatforms bounds fan-out for multi-architecture images when
+	// soci_platforms isn't set.
+	defaultPlatforms = "linux/amd64,linux/arm64"
+
+	// defaultSkipAnnotation is the annotation key checked (for a "true"
+	// value) to decide whether to skip indexing an image, when
+	// soci_skip_annotation isn't set.
+	defaultSkipAnnotation = "soci.amazonaws.com/skip"
+)
+
+// supportedMediaTypes are the manifest types the SOCI snapshotter can build
+// an index for. Anything else (e.g. a plain blob, or an artifact manifest) is
+// skipped.
+var supportedMediaTypes = map[string]bool{
+	registry.MediaTypeDockerManifestList: true,
+	registry.MediaTypeDockerManifest:     true,
+	registry.MediaTypeOCIImageIndex:      true,
+	registry.MediaTypeOCIImageManifest:   true,
+}
+
+// contextKey namespaces values this package stores on a context.Context.
+type contextKey string
+
+// ctxKeyChildDigest carries the platform/digest of the child image currently
+// being processed out of a manifest list, so log lines from the same request
+// can be told apart when fanning out across platforms.
+const ctxKeyChildDigest contextKey = "childDigest"
+
+// HandleRequest is invoked for every ECR Image Action event. It does not
+// check the event's action type or result: every event is handled as a push
+// of Detail.ImageDigest to Detail.RepositoryName.
+func HandleRequest(ctx context.Context, event events.ECRImageActionEvent) (string, error) {
+	repository := event.Detail.RepositoryName
+	digestOrTag := event.Detail.ImageDigest
+
+	logf(ctx, "handling push of %s@%s", repository, digestOrTag)
+
+	reg, err := registry.Init(ctx, registryURL(event))
+	if err != nil {
+		return "", fmt.Errorf("initializing registry client: %w", err)
+	}
+
+	descriptor, err := reg.HeadManifest(ctx, repository, digestOrTag)
+	if err != nil {
+		return "", fmt.Errorf("reading manifest for %s@%s: %w", repository, digestOrTag, err)
+	}
+
+	if !supportedMediaTypes[descriptor.MediaType] {
+		logf(ctx, "%s@%s has unsupported media type %s", repository, digestOrTag, descriptor.MediaType)
+		return respSkippedValidation, nil
+	}
+
+	annotations, err := reg.Annotations(ctx, repository, digestOrTag)
+	if err != nil {
+		return "", fmt.Errorf("reading annotations for %s@%s: %w", repository, digestOrTag, err)
+	}
+	if skippedByAnnotation(annotations) {
+		logf(ctx, "%s@%s skipped by annotation policy", repository, digestOrTag)
+		return respSkippedByAnnotation, nil
+	}
+
+	images, err := reg.GetImageDigests(ctx, repository, digestOrTag, supportedPlatforms())
+	if err != nil {
+		return "", fmt.Errorf("resolving platform digests for %s@%s: %w", repository, digestOrTag, err)
+	}
+
+	indexVersion := writer.IndexVersion(os.Getenv("soci_index_version"))
+	if indexVersion == "" {
+		indexVersion = writer.IndexVersionV1
+	}
+
+	forceOCIMediaTypes, _ := strconv.ParseBool(os.Getenv("soci_force_oci_media_types"))
+	blobMountEnabled, _ := strconv.ParseBool(os.Getenv("soci_enable_blob_mount"))
+	w := writer.New(reg, forceOCIMediaTypes, blobMountEnabled, blobMountSourceRepos())
+
+	var failures []string
+	for _, image := range images {
+		childCtx := withChildDigest(ctx, image.Platform, image.Digest)
+		logf(childCtx, "building and pushing SOCI index")
+		if err := w.BuildAndPushIndex(childCtx, repository, image.Digest, indexVersion); err != nil {
+			logf(childCtx, "failed: %v", err)
+			failures = append(failures, fmt.Sprintf("%s: %v", childLabel(image.Platform, image.Digest), err))
+			continue
+		}
+	}
+
+	if len(failures) > 0 {
+		return "", fmt.Errorf("failed to build/push SOCI index for %d of %d platform(s): %s", len(failures), len(images), strings.Join(failures, "; "))
+	}
+
+	return respSuccess, nil
+}
+
+// registryURL builds the ECR registry hostname the event's image was pushed
+// to.
+func registryURL(event events.ECRImageActionEvent) string {
+	return fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", event.Account, event.Region)
+}
+
+// supportedPlatforms parses the soci_platforms env var (a comma-separated
+// list like "linux/amd64,linux/arm64") used to bound fan-out when indexing a
+// multi-architecture image. Falls back to defaultPlatforms when unset.
+func supportedPlatforms() []string {
+	raw := os.Getenv("soci_platforms")
+	if raw == "" {
+		raw = defaultPlatforms
+	}
+
+	var platforms []string
+	for _, p := range strings.Split(raw, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			platforms = append(platforms, p)
+		}
+	}
+	return platforms
+}
+
+// skippedByAnnotation reports whether annotations carry a truthy value for
+// the configurable skip annotation (soci_skip_annotation, defaulting to
+// defaultSkipAnnotation), used to let image owners opt an image out of SOCI
+// indexing entirely.
+func skippedByAnnotation(annotations map[string]string) bool {
+	key := os.Getenv("soci_skip_annotation")
+	if key == "" {
+		key = defaultSkipAnnotation
+	}
+
+	value, ok := annotations[key]
+	if !ok {
+		return false
+	}
+
+	skip, _ := strconv.ParseBool(value)
+	return skip
+}
+
+// blobMountSourceRepos parses the soci_blob_mount_sources env var (a
+// comma-separated list of repositories, e.g. "shared/blob-cache") that may
+// already hold blobs the SOCI index references, so they can be mounted
+// instead of re-uploaded. Only consulted when soci_enable_blob_mount is set.
+func blobMountSourceRepos() []string {
+	raw := os.Getenv("soci_blob_mount_sources")
+	if raw == "" {
+		return nil
+	}
+
+	var repos []string
+	for _, r := range strings.Split(raw, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			repos = append(repos, r)
+		}
+	}
+	return repos
+}
+
+// withChildDigest records the platform/digest of the child image currently
+// being processed out of a manifest list, for inclusion in log lines.
+func withChildDigest(ctx context.Context, platform, digest string) context.Context {
+	return context.WithValue(ctx, ctxKeyChildDigest, childLabel(platform, digest))
+}
+
+func childLabel(platform, digest string) string {
+	if platform == "" {
+		return digest
+	}
+	return fmt.Sprintf("%s (%s)", digest, platform)
+}
+
+// logf writes a log line prefixed with the Lambda request ID and, when
+// present, the child image digest currently being processed.
+func logf(ctx context.Context, format string, args ...interface{}) {
+	prefix := ""
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc != nil {
+		prefix = lc.AwsRequestID
+	}
+	if child, ok := ctx.Value(ctxKeyChildDigest).(string); ok && child != "" {
+		prefix = fmt.Sprintf("%s %s", prefix, child)
+	}
+	fmt.Printf("[%s] %s\n", prefix, fmt.Sprintf(format, args...))
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
@@ -0,0 +1,79 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+)
+
+// authorizer sets the credentials needed to talk to a repository on a
+// request.
+type authorizer interface {
+	authorize(ctx context.Context, req *http.Request, repository string) error
+}
+
+// newAuthorizer picks the right credential source for registryUrl: private
+// ECR registries authenticate with the ECR GetAuthorizationToken API,
+// everything else (public ECR, Docker Hub, etc.) is treated as anonymous,
+// relying on the registries' public pull policies.
+func newAuthorizer(ctx context.Context, registryUrl string) (authorizer, error) {
+	if strings.Contains(registryUrl, ".dkr.ecr.") {
+		return newEcrAuthorizer(ctx, registryUrl)
+	}
+	return anonymousAuthorizer{}, nil
+}
+
+// anonymousAuthorizer sends no credentials; used for public registries.
+type anonymousAuthorizer struct{}
+
+func (anonymousAuthorizer) authorize(context.Context, *http.Request, string) error {
+	return nil
+}
+
+// ecrAuthorizer authenticates against a private ECR registry using a
+// short-lived basic auth token obtained through the ECR API.
+type ecrAuthorizer struct {
+	username string
+	password string
+}
+
+func newEcrAuthorizer(ctx context.Context, registryUrl string) (*ecrAuthorizer, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+
+	client := ecr.NewFromConfig(cfg)
+	out, err := client.GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return nil, fmt.Errorf("getting ECR authorization token for %s: %w", registryUrl, err)
+	}
+	if len(out.AuthorizationData) == 0 {
+		return nil, fmt.Errorf("no ECR authorization data returned for %s", registryUrl)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(*out.AuthorizationData[0].AuthorizationToken)
+	if err != nil {
+		return nil, fmt.Errorf("decoding ECR authorization token: %w", err)
+	}
+
+	userPass := strings.SplitN(string(decoded), ":", 2)
+	if len(userPass) != 2 {
+		return nil, fmt.Errorf("malformed ECR authorization token")
+	}
+
+	return &ecrAuthorizer{username: userPass[0], password: userPass[1]}, nil
+}
+
+func (a *ecrAuthorizer) authorize(_ context.Context, req *http.Request, _ string) error {
+	req.SetBasicAuth(a.username, a.password)
+	return nil
+}
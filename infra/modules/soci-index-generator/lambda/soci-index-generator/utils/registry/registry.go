@@ -0,0 +1,474 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package registry is a minimal client for the Docker Registry HTTP API V2
+// (https://docs.docker.com/registry/spec/api/), used to fetch and push the
+// manifests and blobs that make up SOCI indices.
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrManifestNotFound is returned by GetManifestBytes (and anything built on
+// it) when the registry reports 404 for the requested manifest, so callers
+// doing a read-modify-write (e.g. a referrers list) can tell "doesn't exist
+// yet" apart from a transient or auth failure that should instead be
+// propagated.
+var ErrManifestNotFound = errors.New("manifest not found")
+
+const (
+	MediaTypeDockerManifestList           = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest               = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerImageConfig            = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerImageRootfsDiffTarGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	MediaTypeOCIImageIndex    = ocispec.MediaTypeImageIndex
+	MediaTypeOCIImageManifest = ocispec.MediaTypeImageManifest
+	MediaTypeOCIImageConfig   = ocispec.MediaTypeImageConfig
+	MediaTypeOCIImageLayer    = ocispec.MediaTypeImageLayerGzip
+)
+
+// dockerToOCIMediaTypes maps the Docker-specific media types that can appear
+// on a SOCI artifact's manifest to their OCI equivalents, for registries that
+// reject Docker vendor types (e.g. zot).
+var dockerToOCIMediaTypes = map[string]string{
+	MediaTypeDockerManifest:               MediaTypeOCIImageManifest,
+	MediaTypeDockerImageConfig:            MediaTypeOCIImageConfig,
+	MediaTypeDockerImageRootfsDiffTarGzip: MediaTypeOCIImageLayer,
+}
+
+// acceptedManifestTypes is sent as the Accept header on manifest reads so the
+// registry can return manifest lists / image indices as well as single
+// platform manifests.
+var acceptedManifestTypes = []string{
+	MediaTypeDockerManifestList,
+	MediaTypeDockerManifest,
+	MediaTypeOCIImageIndex,
+	MediaTypeOCIImageManifest,
+}
+
+// Registry is a client for a single Docker Registry HTTP API V2 endpoint,
+// pre-authenticated for the repositories the Lambda is configured to access.
+type Registry struct {
+	url    string
+	client *http.Client
+	auth   authorizer
+}
+
+// Init creates a Registry client for registryUrl (e.g.
+// "<account>.dkr.ecr.<region>.amazonaws.com", "public.ecr.aws" or
+// "docker.io"), resolving credentials appropriate for that registry.
+func Init(ctx context.Context, registryUrl string) (*Registry, error) {
+	auth, err := newAuthorizer(ctx, registryUrl)
+	if err != nil {
+		return nil, fmt.Errorf("resolving credentials for registry %s: %w", registryUrl, err)
+	}
+
+	return &Registry{
+		url:    registryUrl,
+		client: http.DefaultClient,
+		auth:   auth,
+	}, nil
+}
+
+func (r *Registry) manifestURL(repository, digestOrTag string) string {
+	return fmt.Sprintf("https://%s/v2/%s/manifests/%s", r.url, repository, digestOrTag)
+}
+
+func (r *Registry) newManifestRequest(ctx context.Context, method, repository, digestOrTag string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, r.manifestURL(repository, digestOrTag), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(acceptedManifestTypes, ", "))
+	if err := r.auth.authorize(ctx, req, repository); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// HeadManifest issues a HEAD request for the manifest identified by
+// digestOrTag, returning its descriptor (media type, digest and size) without
+// downloading the manifest body.
+func (r *Registry) HeadManifest(ctx context.Context, repository, digestOrTag string) (ocispec.Descriptor, error) {
+	req, err := r.newManifestRequest(ctx, http.MethodHead, repository, digestOrTag)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ocispec.Descriptor{}, fmt.Errorf("HEAD manifest %s/%s: unexpected status %s", repository, digestOrTag, resp.Status)
+	}
+
+	return ocispec.Descriptor{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    digestFromHeaderOrRef(resp, digestOrTag),
+		Size:      resp.ContentLength,
+	}, nil
+}
+
+// GetManifest fetches and parses the manifest identified by digestOrTag. The
+// returned ocispec.Manifest is also used to represent manifest lists / image
+// indices; callers that care about the list of child manifests should parse
+// the raw bytes themselves or use a type aware of the difference. The
+// manifest's OCI annotations, if any, are preserved on its Annotations field.
+func (r *Registry) GetManifest(ctx context.Context, repository, digestOrTag string) (ocispec.Manifest, error) {
+	body, _, err := r.getManifestBytes(ctx, repository, digestOrTag)
+	if err != nil {
+		return ocispec.Manifest{}, err
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return ocispec.Manifest{}, fmt.Errorf("parsing manifest %s/%s: %w", repository, digestOrTag, err)
+	}
+
+	return manifest, nil
+}
+
+// Annotations returns the OCI annotations declared on the manifest
+// identified by digestOrTag (e.g. "soci.amazonaws.com/skip"), or nil if it
+// has none. It is a thin convenience wrapper over GetManifest for callers
+// that only care about annotation-driven policy decisions.
+func (r *Registry) Annotations(ctx context.Context, repository, digestOrTag string) (map[string]string, error) {
+	manifest, err := r.GetManifest(ctx, repository, digestOrTag)
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Annotations, nil
+}
+
+// GetManifestBytes fetches the raw, unparsed manifest bytes for digestOrTag
+// along with the descriptor the registry reported for them. Callers that
+// need to rewrite and re-push a manifest (e.g. to convert its media types)
+// should use this instead of GetManifest, which only returns the parsed
+// form.
+func (r *Registry) GetManifestBytes(ctx context.Context, repository, digestOrTag string) ([]byte, ocispec.Descriptor, error) {
+	return r.getManifestBytes(ctx, repository, digestOrTag)
+}
+
+func (r *Registry) getManifestBytes(ctx context.Context, repository, digestOrTag string) ([]byte, ocispec.Descriptor, error) {
+	req, err := r.newManifestRequest(ctx, http.MethodGet, repository, digestOrTag)
+	if err != nil {
+		return nil, ocispec.Descriptor{}, err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, ocispec.Descriptor{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ocispec.Descriptor{}, fmt.Errorf("GET manifest %s/%s: %w", repository, digestOrTag, ErrManifestNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, ocispec.Descriptor{}, fmt.Errorf("GET manifest %s/%s: unexpected status %s", repository, digestOrTag, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, ocispec.Descriptor{}, err
+	}
+
+	descriptor := ocispec.Descriptor{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    digestFromHeaderOrRef(resp, digestOrTag),
+		Size:      int64(len(body)),
+	}
+
+	return body, descriptor, nil
+}
+
+// PushManifest uploads manifest under the given tag or digest reference and
+// returns the digest the registry computed for it. When forceOCIMediaTypes is
+// set, any Docker-specific media types on manifest (and its top-level
+// mediaType) are rewritten to their OCI equivalents before the push, and the
+// digest returned reflects the rewritten bytes, so callers doing referrer
+// linkage use the digest that was actually pushed.
+func (r *Registry) PushManifest(ctx context.Context, repository, digestOrTag, mediaType string, manifest []byte, forceOCIMediaTypes bool) (digest.Digest, error) {
+	if forceOCIMediaTypes {
+		rewritten, err := ConvertToOCIMediaTypes(manifest)
+		if err != nil {
+			return "", fmt.Errorf("converting manifest %s/%s to OCI media types: %w", repository, digestOrTag, err)
+		}
+		manifest = rewritten
+		if ociType, ok := dockerToOCIMediaTypes[mediaType]; ok {
+			mediaType = ociType
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, r.manifestURL(repository, digestOrTag), bytes.NewReader(manifest))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	req.ContentLength = int64(len(manifest))
+	if err := r.auth.authorize(ctx, req, repository); err != nil {
+		return "", err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("PUT manifest %s/%s: unexpected status %s", repository, digestOrTag, resp.Status)
+	}
+
+	if pushed := resp.Header.Get("Docker-Content-Digest"); pushed != "" {
+		return digest.Digest(pushed), nil
+	}
+	return digest.FromBytes(manifest), nil
+}
+
+// ConvertToOCIMediaTypes rewrites the Docker-specific media types on a
+// manifest's top-level mediaType, config descriptor and layer descriptors to
+// their OCI equivalents (see dockerToOCIMediaTypes), returning the
+// re-encoded bytes. Because the digest of a manifest is computed over its
+// bytes, callers must treat the returned bytes as having a new digest.
+func ConvertToOCIMediaTypes(raw []byte) ([]byte, error) {
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, fmt.Errorf("parsing manifest: %w", err)
+	}
+
+	if ociType, ok := dockerToOCIMediaTypes[manifest.MediaType]; ok {
+		manifest.MediaType = ociType
+	}
+	if ociType, ok := dockerToOCIMediaTypes[manifest.Config.MediaType]; ok {
+		manifest.Config.MediaType = ociType
+	}
+	for i, layer := range manifest.Layers {
+		if ociType, ok := dockerToOCIMediaTypes[layer.MediaType]; ok {
+			manifest.Layers[i].MediaType = ociType
+		}
+	}
+
+	rewritten, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("re-encoding manifest: %w", err)
+	}
+	return rewritten, nil
+}
+
+func digestFromHeaderOrRef(resp *http.Response, digestOrTag string) digest.Digest {
+	if d := resp.Header.Get("Docker-Content-Digest"); d != "" {
+		return digest.Digest(d)
+	}
+	return digest.Digest(digestOrTag)
+}
+
+// ImageDigest identifies a single-platform image that is a child of a
+// manifest list / image index, or the image itself when it isn't a list.
+type ImageDigest struct {
+	// Platform is "<os>/<architecture>" (e.g. "linux/amd64"), empty when
+	// digestOrTag already referred to a single-platform image.
+	Platform string
+	Digest   string
+}
+
+// GetImageDigests inspects the manifest identified by digestOrTag and
+// returns the digest(s) of the image(s) it refers to. If it is a manifest
+// list or OCI image index, the child manifests are filtered down to
+// supportedPlatforms (when non-empty) and one ImageDigest is returned per
+// matching platform; otherwise a single ImageDigest for digestOrTag itself is
+// returned.
+func (r *Registry) GetImageDigests(ctx context.Context, repository, digestOrTag string, supportedPlatforms []string) ([]ImageDigest, error) {
+	descriptor, err := r.HeadManifest(ctx, repository, digestOrTag)
+	if err != nil {
+		return nil, err
+	}
+
+	if descriptor.MediaType != MediaTypeDockerManifestList && descriptor.MediaType != MediaTypeOCIImageIndex {
+		return []ImageDigest{{Digest: digestOrTag}}, nil
+	}
+
+	body, _, err := r.getManifestBytes(ctx, repository, digestOrTag)
+	if err != nil {
+		return nil, err
+	}
+
+	var index ocispec.Index
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, fmt.Errorf("parsing image index %s/%s: %w", repository, digestOrTag, err)
+	}
+
+	allowed := platformSet(supportedPlatforms)
+
+	var digests []ImageDigest
+	for _, child := range index.Manifests {
+		if child.Platform == nil {
+			continue
+		}
+		platform := fmt.Sprintf("%s/%s", child.Platform.OS, child.Platform.Architecture)
+		if len(allowed) > 0 && !allowed[platform] {
+			continue
+		}
+		digests = append(digests, ImageDigest{Platform: platform, Digest: string(child.Digest)})
+	}
+
+	if len(digests) == 0 {
+		return nil, fmt.Errorf("image index %s/%s has no platforms matching the configured allowlist %v", repository, digestOrTag, supportedPlatforms)
+	}
+
+	return digests, nil
+}
+
+// MountBlobResult is the outcome of a MountBlob call.
+type MountBlobResult struct {
+	// Mounted is true when the registry accepted the cross-repository mount
+	// (201 Created) and no further upload is needed.
+	Mounted bool
+
+	// UploadLocation is set when Mounted is false: the registry started a
+	// new upload session (202 Accepted) instead of mounting, per the
+	// distribution spec's fallback behavior. The caller is responsible for
+	// either completing that session with a PUT of the blob content, or
+	// cancelling it.
+	UploadLocation string
+}
+
+// MountBlob attempts to mount an existing blob into targetRepo without
+// re-uploading it, by POSTing
+// /v2/<targetRepo>/blobs/uploads/?mount=<digest>&from=<sourceRepo>. If
+// sourceRepo is empty, it attempts the OCI 1.1 "mount without from" variant
+// (bare ?mount=<digest>), which succeeds only if the registry can otherwise
+// locate a blob with that digest.
+func (r *Registry) MountBlob(ctx context.Context, targetRepo, blobDigest, sourceRepo string) (MountBlobResult, error) {
+	u := fmt.Sprintf("https://%s/v2/%s/blobs/uploads/?mount=%s", r.url, targetRepo, blobDigest)
+	if sourceRepo != "" {
+		u = fmt.Sprintf("%s&from=%s", u, sourceRepo)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	if err != nil {
+		return MountBlobResult{}, err
+	}
+	req.ContentLength = 0
+	if err := r.auth.authorize(ctx, req, targetRepo); err != nil {
+		return MountBlobResult{}, err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return MountBlobResult{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return MountBlobResult{Mounted: true}, nil
+	case http.StatusAccepted:
+		return MountBlobResult{Mounted: false, UploadLocation: resp.Header.Get("Location")}, nil
+	default:
+		return MountBlobResult{}, fmt.Errorf("mount blob %s into %s: unexpected status %s", blobDigest, targetRepo, resp.Status)
+	}
+}
+
+// CancelBlobUpload aborts the upload session at uploadLocation (as returned
+// in a MountBlobResult), so the registry can free the resources it
+// allocated for it. Used when a MountBlob fallback turns out to have no
+// matching blob and the caller has no content to complete the upload with.
+// Per the distribution spec, uploadLocation (the Location header) may be
+// relative to the registry, so it's resolved against the registry's base URL
+// before use.
+func (r *Registry) CancelBlobUpload(ctx context.Context, targetRepo, uploadLocation string) error {
+	resolved, err := r.resolveLocation(uploadLocation)
+	if err != nil {
+		return fmt.Errorf("resolving upload location %q: %w", uploadLocation, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, resolved, nil)
+	if err != nil {
+		return err
+	}
+	if err := r.auth.authorize(ctx, req, targetRepo); err != nil {
+		return err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("cancel blob upload at %s: unexpected status %s", uploadLocation, resp.Status)
+	}
+	return nil
+}
+
+// resolveLocation resolves a (possibly relative) Location header value
+// against the registry's base URL, per the distribution spec allowing
+// servers to return either an absolute or relative URL.
+func (r *Registry) resolveLocation(location string) (string, error) {
+	ref, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	base := &url.URL{Scheme: "https", Host: r.url}
+	return base.ResolveReference(ref).String(), nil
+}
+
+func (r *Registry) referrersURL(repository, subjectDigest string) string {
+	return fmt.Sprintf("https://%s/v2/%s/referrers/%s", r.url, repository, subjectDigest)
+}
+
+// SupportsReferrersAPI reports whether the registry implements the OCI 1.1
+// Referrers API (https://v1-1.oci.dev/distribution/spec/#listing-referrers)
+// for subjectDigest, by probing HEAD /v2/<repository>/referrers/<subjectDigest>:
+// a 404 means the registry is OCI 1.0 and callers must fall back to a
+// tag-based referrers list instead.
+func (r *Registry) SupportsReferrersAPI(ctx context.Context, repository, subjectDigest string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, r.referrersURL(repository, subjectDigest), nil)
+	if err != nil {
+		return false, err
+	}
+	if err := r.auth.authorize(ctx, req, repository); err != nil {
+		return false, err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("probing referrers API for %s/%s: unexpected status %s", repository, subjectDigest, resp.Status)
+	}
+}
+
+func platformSet(platforms []string) map[string]bool {
+	set := make(map[string]bool, len(platforms))
+	for _, p := range platforms {
+		set[p] = true
+	}
+	return set
+}
@@ -5,6 +5,8 @@ package registry
 
 import (
 	"context"
+	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-lambda-go/lambdacontext"
@@ -133,3 +135,155 @@ func TestGetManifest(t *testing.T) {
 	}
 	doTest("docker.io", "library/redis", "sha256:afd1957d6b59bfff9615d7ec07001afb4eeea39eb341fc777c0caac3fcf52187", expected)
 }
+
+// TestConvertToOCIMediaTypes fetches a real manifest with Docker-specific
+// media types and asserts that ConvertToOCIMediaTypes rewrites the manifest,
+// config and layer media types to their OCI equivalents.
+func TestConvertToOCIMediaTypes(t *testing.T) {
+	lc := lambdacontext.LambdaContext{}
+	lc.AwsRequestID = "abcd-1234-test-convert-to-oci-media-types"
+	ctx := lambdacontext.NewContext(context.Background(), &lc)
+
+	registry, err := Init(ctx, "public.ecr.aws")
+	if err != nil {
+		panic(err)
+	}
+
+	raw, descriptor, err := registry.GetManifestBytes(context.Background(), "lambda/python", "3.10-x86_64")
+	if err != nil {
+		panic(err)
+	}
+	if descriptor.MediaType != MediaTypeDockerManifest {
+		t.Fatalf("fixture precondition failed: expected %s, got %s", MediaTypeDockerManifest, descriptor.MediaType)
+	}
+
+	converted, err := ConvertToOCIMediaTypes(raw)
+	if err != nil {
+		t.Fatalf("ConvertToOCIMediaTypes failed: %v", err)
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(converted, &manifest); err != nil {
+		t.Fatalf("unmarshalling converted manifest: %v", err)
+	}
+
+	if manifest.MediaType != MediaTypeOCIImageManifest {
+		t.Fatalf("expected manifest media type %s, got %s", MediaTypeOCIImageManifest, manifest.MediaType)
+	}
+	if manifest.Config.MediaType != MediaTypeOCIImageConfig {
+		t.Fatalf("expected config media type %s, got %s", MediaTypeOCIImageConfig, manifest.Config.MediaType)
+	}
+	for _, layer := range manifest.Layers {
+		if layer.MediaType == MediaTypeDockerImageRootfsDiffTarGzip {
+			t.Fatalf("layer %s still has Docker media type after conversion", layer.Digest)
+		}
+	}
+}
+
+// TestGetImageDigests exercises the platform-filtering and single-manifest
+// fallback behavior of GetImageDigests against real multi-arch and
+// single-arch images.
+func TestGetImageDigests(t *testing.T) {
+	lc := lambdacontext.LambdaContext{}
+	lc.AwsRequestID = "abcd-1234-test-get-image-digests"
+	ctx := lambdacontext.NewContext(context.Background(), &lc)
+
+	registry, err := Init(ctx, "public.ecr.aws")
+	if err != nil {
+		panic(err)
+	}
+
+	// A manifest list filtered to a platform allowlist returns one
+	// ImageDigest per matching child, each tagged with its platform.
+	digests, err := registry.GetImageDigests(context.Background(), "docker/library/redis", "7", []string{"linux/amd64", "linux/arm64"})
+	if err != nil {
+		t.Fatalf("GetImageDigests failed: %v", err)
+	}
+	if len(digests) == 0 {
+		t.Fatalf("fixture precondition failed: docker/library/redis:7 matched no platforms in the allowlist")
+	}
+	seenPlatforms := map[string]bool{"linux/amd64": true, "linux/arm64": true}
+	for _, d := range digests {
+		if !seenPlatforms[d.Platform] {
+			t.Fatalf("unexpected platform %q in result %+v, want one of linux/amd64, linux/arm64", d.Platform, d)
+		}
+		if !strings.HasPrefix(d.Digest, "sha256:") {
+			t.Fatalf("unexpected digest %q in result %+v", d.Digest, d)
+		}
+	}
+
+	// A single-manifest image (not a list) returns exactly one ImageDigest
+	// for digestOrTag itself, with no platform attached.
+	digests, err = registry.GetImageDigests(context.Background(), "lambda/python", "3.10-x86_64", []string{"linux/amd64", "linux/arm64"})
+	if err != nil {
+		t.Fatalf("GetImageDigests failed: %v", err)
+	}
+	if len(digests) != 1 || digests[0].Platform != "" || digests[0].Digest != "3.10-x86_64" {
+		t.Fatalf("expected a single unplatformed ImageDigest for 3.10-x86_64, got %+v", digests)
+	}
+
+	// An allowlist matching none of a manifest list's platforms is an error,
+	// not a silently empty result.
+	if _, err := registry.GetImageDigests(context.Background(), "lambda/python", "3.10", []string{"linux/bogus"}); err == nil {
+		t.Fatalf("expected an error when no platform in the allowlist matches, got nil")
+	}
+}
+
+// TestGetManifestAnnotations asserts that whatever OCI annotations a real
+// manifest carries flow through GetManifest (and the Annotations helper)
+// without being dropped or mutated. The expected annotations come from
+// unmarshalling the raw manifest bytes into a minimal local type, independent
+// of ocispec.Manifest and the Annotations helper, so a regression in either
+// would actually fail this test rather than being compared against itself.
+// The fixture is also asserted to carry at least one annotation, so the
+// comparison can't vacuously pass against two empty maps.
+func TestGetManifestAnnotations(t *testing.T) {
+	type rawManifest struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+
+	doTest := func(registryUrl, repository, digestOrTag string) {
+		lc := lambdacontext.LambdaContext{}
+		lc.AwsRequestID = "abcd-1234-test-get-manifest-annotations"
+		ctx := lambdacontext.NewContext(context.Background(), &lc)
+		registry, err := Init(ctx, registryUrl)
+		if err != nil {
+			panic(err)
+		}
+
+		raw, _, err := registry.GetManifestBytes(context.Background(), repository, digestOrTag)
+		if err != nil {
+			panic(err)
+		}
+
+		var parsed rawManifest
+		if err := json.Unmarshal(raw, &parsed); err != nil {
+			t.Fatalf("parsing raw manifest: %v", err)
+		}
+		if len(parsed.Annotations) == 0 {
+			t.Fatalf("fixture precondition failed: %s/%s carries no annotations to assert against", repository, digestOrTag)
+		}
+
+		manifest, err := registry.GetManifest(context.Background(), repository, digestOrTag)
+		if err != nil {
+			panic(err)
+		}
+		annotations, err := registry.Annotations(context.Background(), repository, digestOrTag)
+		if err != nil {
+			t.Fatalf("Annotations failed: %v", err)
+		}
+
+		for _, got := range []map[string]string{manifest.Annotations, annotations} {
+			if len(got) != len(parsed.Annotations) {
+				t.Fatalf("got %d annotations, expected %d (%v)", len(got), len(parsed.Annotations), parsed.Annotations)
+			}
+			for k, v := range parsed.Annotations {
+				if got[k] != v {
+					t.Fatalf("annotation %q: expected %q, got %q", k, v, got[k])
+				}
+			}
+		}
+	}
+
+	doTest("public.ecr.aws", "lambda/python", "3.10-x86_64")
+}
@@ -0,0 +1,496 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package writer builds SOCI indices for container images and pushes them
+// back to the source registry, alongside the image they describe.
+package writer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// sociBinaryPath is the path, inside the Lambda's container image, to the
+// soci CLI used to build ztocs from a pulled image.
+const sociBinaryPath = "/usr/local/bin/soci"
+
+// Provenance annotations stamped onto every generated SOCI index manifest so
+// it is self-describing when later fetched.
+const (
+	annotationBuilderRequestID = "com.amazonaws.soci.builder.request-id"
+	annotationSourceDigest     = "com.amazonaws.soci.source.digest"
+	annotationIndexVersion     = "com.amazonaws.soci.index.version"
+)
+
+// artifactTypeSOCIIndex is the artifactType stamped onto every generated SOCI
+// index manifest. It identifies the manifest as a SOCI index specifically
+// (as opposed to manifest.Config.MediaType, which other artifact kinds like
+// signatures or SBOMs can share), so the OCI 1.0 referrers-list fallback can
+// tell its own entries apart from ones other tooling added to the same list.
+const artifactTypeSOCIIndex = "application/vnd.amazonaws.soci.index.v1+json"
+
+// IndexVersion selects the shape of the SOCI index manifest that gets pushed.
+type IndexVersion string
+
+const (
+	IndexVersionV1 IndexVersion = "V1"
+	IndexVersionV2 IndexVersion = "V2"
+)
+
+// Writer builds and pushes a SOCI index for a single image digest.
+type Writer struct {
+	Registry *registry.Registry
+
+	// ForceOCIMediaTypes, when set, rewrites any Docker-specific media types
+	// on the pushed SOCI index manifest to their OCI equivalents, for
+	// registries that are strict about only accepting OCI media types.
+	ForceOCIMediaTypes bool
+
+	// BlobMountEnabled turns on the cross-repo blob mount optimization (see
+	// buildAndPushWithBlobMount). It is off by default: that optimization
+	// relies on soci CLI flags (--output, --manifest-file, --skip-blobs) this
+	// repo cannot confirm every installed soci binary actually supports, so
+	// it must be explicitly opted into rather than run on every push.
+	BlobMountEnabled bool
+
+	// BlobMountSourceRepos are additional repositories (e.g. shared "blob
+	// cache" repos) to try mounting ztoc/config blobs from, beyond the
+	// source image's own repository, once BlobMountEnabled is set.
+	BlobMountSourceRepos []string
+}
+
+// New returns a Writer that pushes to reg.
+func New(reg *registry.Registry, forceOCIMediaTypes, blobMountEnabled bool, blobMountSourceRepos []string) *Writer {
+	return &Writer{
+		Registry:             reg,
+		ForceOCIMediaTypes:   forceOCIMediaTypes,
+		BlobMountEnabled:     blobMountEnabled,
+		BlobMountSourceRepos: blobMountSourceRepos,
+	}
+}
+
+// BuildAndPushIndex pulls the image at repository/imageDigest, builds a SOCI
+// index for it with the soci CLI, and pushes the resulting index manifest
+// (and its ztoc layers) back to repository. When BlobMountEnabled is set, it
+// first tries the cross-repo blob mount optimization (see
+// buildAndPushWithBlobMount); since this repo cannot confirm every installed
+// soci CLI supports the flags that optimization needs, a CLI usage error
+// falls back to the plain create/push invocation everyone else uses.
+func (w *Writer) BuildAndPushIndex(ctx context.Context, repository, imageDigest string, version IndexVersion) error {
+	ref := fmt.Sprintf("%s@%s", repository, imageDigest)
+
+	if w.BlobMountEnabled {
+		err := w.buildAndPushWithBlobMount(ctx, repository, ref, version)
+		if err == nil {
+			return w.finishPush(ctx, repository, imageDigest, version, ref)
+		}
+		if !isUnsupportedFlagError(err) {
+			return err
+		}
+	}
+
+	if err := w.legacyCreate(ctx, ref, version); err != nil {
+		return fmt.Errorf("building SOCI index for %s: %w", ref, err)
+	}
+	if err := w.legacyPush(ctx, ref); err != nil {
+		return fmt.Errorf("pushing SOCI index for %s: %w", ref, err)
+	}
+
+	return w.finishPush(ctx, repository, imageDigest, version, ref)
+}
+
+// legacyCreate builds a SOCI index the way every soci CLI version is known to
+// support: no flags beyond --index-version. Its output lands wherever the CLI
+// stores it by default (its local content store), to be read back by push.
+func (w *Writer) legacyCreate(ctx context.Context, ref string, version IndexVersion) error {
+	cmd := exec.CommandContext(ctx, sociBinaryPath, "create", ref, "--index-version", string(version))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, output)
+	}
+	return nil
+}
+
+// legacyPush pushes the index the preceding create step built, with no
+// cross-repo blob mount optimization.
+func (w *Writer) legacyPush(ctx context.Context, ref string) error {
+	cmd := exec.CommandContext(ctx, sociBinaryPath, "push", ref)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, output)
+	}
+	return nil
+}
+
+// buildAndPushWithBlobMount is the cross-repo blob mount optimization: it
+// asks the soci CLI to write the index manifest it builds to a file so this
+// package can inspect its blobs, mounts whichever of them are already
+// reachable from the source repository or a configured blob mount source,
+// and tells push to skip re-uploading those. This depends on --output on
+// create and --manifest-file/--skip-blobs on push, none of which this repo
+// can verify are supported by every installed soci CLI version; callers
+// should treat a returned error as possibly meaning "unsupported" (see
+// isUnsupportedFlagError) and fall back to the legacy invocation.
+func (w *Writer) buildAndPushWithBlobMount(ctx context.Context, repository, ref string, version IndexVersion) error {
+	manifestFile, err := os.CreateTemp("", "soci-index-*.json")
+	if err != nil {
+		return fmt.Errorf("creating temp file for SOCI index manifest: %w", err)
+	}
+	manifestFile.Close()
+	defer os.Remove(manifestFile.Name())
+
+	cmd := exec.CommandContext(ctx, sociBinaryPath, "create", ref, "--index-version", string(version), "--output", manifestFile.Name())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("building SOCI index for %s: %w: %s", ref, err, output)
+	}
+
+	mountedBlobs, err := w.mountSharedBlobs(ctx, repository, manifestFile.Name())
+	if err != nil {
+		return fmt.Errorf("mounting shared blobs for %s: %w", ref, err)
+	}
+
+	pushArgs := []string{"push", ref, "--manifest-file", manifestFile.Name()}
+	if len(mountedBlobs) > 0 {
+		pushArgs = append(pushArgs, "--skip-blobs", strings.Join(mountedBlobs, ","))
+	}
+	cmd = exec.CommandContext(ctx, sociBinaryPath, pushArgs...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pushing SOCI index for %s: %w: %s", ref, err, output)
+	}
+
+	return nil
+}
+
+// isUnsupportedFlagError reports whether err looks like it came from the soci
+// CLI rejecting a flag it doesn't recognize, rather than from an actual
+// build/push failure. It is necessarily a heuristic: this repo doesn't vendor
+// or pin the soci CLI, so it can't assert the exact flag parser in use.
+func isUnsupportedFlagError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, marker := range []string{
+		"unknown flag",
+		"unknown shorthand flag",
+		"flag provided but not defined",
+		"unrecognized flag",
+		"unrecognized option",
+	} {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// finishPush stamps provenance annotations onto the just-pushed SOCI index
+// and, depending on configuration, converts it to OCI media types and/or
+// links it to its subject image. It runs regardless of which of
+// BuildAndPushIndex's create/push paths produced the index.
+func (w *Writer) finishPush(ctx context.Context, repository, imageDigest string, version IndexVersion, ref string) error {
+	if err := w.stampProvenance(ctx, repository, imageDigest, version); err != nil {
+		return fmt.Errorf("stamping provenance annotations for %s: %w", ref, err)
+	}
+
+	if w.ForceOCIMediaTypes {
+		if err := w.convertPushedIndexToOCI(ctx, repository, imageDigest); err != nil {
+			return fmt.Errorf("converting SOCI index for %s to OCI media types: %w", ref, err)
+		}
+	}
+
+	if version == IndexVersionV2 {
+		if err := w.linkSubject(ctx, repository, imageDigest); err != nil {
+			return fmt.Errorf("linking SOCI index for %s to its subject image: %w", ref, err)
+		}
+	}
+
+	return nil
+}
+
+// mountSharedBlobs reads the SOCI index manifest at manifestPath and, for
+// each of its blobs (config and ztoc layers), tries to have the registry
+// mount an identical blob it already has rather than re-uploading it. It
+// returns the digests that were successfully mounted, so the caller can tell
+// the push step to skip them.
+func (w *Writer) mountSharedBlobs(ctx context.Context, repository, manifestPath string) ([]string, error) {
+	raw, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading SOCI index manifest: %w", err)
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, fmt.Errorf("parsing SOCI index manifest: %w", err)
+	}
+
+	blobs := make([]string, 0, len(manifest.Layers)+1)
+	if manifest.Config.Digest != "" {
+		blobs = append(blobs, string(manifest.Config.Digest))
+	}
+	for _, layer := range manifest.Layers {
+		blobs = append(blobs, string(layer.Digest))
+	}
+
+	sourceRepos := append([]string{repository}, w.BlobMountSourceRepos...)
+
+	var mounted []string
+	for _, blob := range blobs {
+		if w.mountBlob(ctx, repository, blob, sourceRepos) {
+			mounted = append(mounted, blob)
+		}
+	}
+	return mounted, nil
+}
+
+// mountBlob tries to mount blobDigest into repository from each of
+// sourceRepos in turn, falling back to the OCI 1.1 "mount without from"
+// variant (letting the registry locate the blob itself) when none of them
+// work. Any upload session the registry opens as part of a failed mount
+// attempt is cancelled so it doesn't leak.
+func (w *Writer) mountBlob(ctx context.Context, repository, blobDigest string, sourceRepos []string) bool {
+	for _, source := range sourceRepos {
+		if w.tryMount(ctx, repository, blobDigest, source) {
+			return true
+		}
+	}
+	return w.tryMount(ctx, repository, blobDigest, "")
+}
+
+func (w *Writer) tryMount(ctx context.Context, repository, blobDigest, sourceRepo string) bool {
+	result, err := w.Registry.MountBlob(ctx, repository, blobDigest, sourceRepo)
+	if err != nil {
+		return false
+	}
+	if result.Mounted {
+		return true
+	}
+	if result.UploadLocation != "" {
+		_ = w.Registry.CancelBlobUpload(ctx, repository, result.UploadLocation)
+	}
+	return false
+}
+
+// stampProvenance adds provenance annotations to the pushed SOCI index
+// manifest (org.opencontainers.image.created and the com.amazonaws.soci.*
+// keys above) and stamps its artifactType as artifactTypeSOCIIndex, so the
+// artifact is self-describing when later fetched, even without access to
+// this Lambda's logs.
+func (w *Writer) stampProvenance(ctx context.Context, repository, imageDigest string, version IndexVersion) error {
+	tag, err := sociIndexTag(imageDigest)
+	if err != nil {
+		return err
+	}
+
+	raw, descriptor, err := w.Registry.GetManifestBytes(ctx, repository, tag)
+	if err != nil {
+		return fmt.Errorf("fetching SOCI index manifest %s/%s: %w", repository, tag, err)
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return fmt.Errorf("parsing SOCI index manifest %s/%s: %w", repository, tag, err)
+	}
+
+	manifest.ArtifactType = artifactTypeSOCIIndex
+
+	if manifest.Annotations == nil {
+		manifest.Annotations = map[string]string{}
+	}
+	manifest.Annotations[ocispec.AnnotationCreated] = time.Now().UTC().Format(time.RFC3339)
+	manifest.Annotations[annotationSourceDigest] = imageDigest
+	manifest.Annotations[annotationIndexVersion] = string(version)
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc != nil {
+		manifest.Annotations[annotationBuilderRequestID] = lc.AwsRequestID
+	}
+
+	rewritten, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("re-encoding SOCI index manifest %s/%s: %w", repository, tag, err)
+	}
+
+	if _, err := w.Registry.PushManifest(ctx, repository, tag, descriptor.MediaType, rewritten, false); err != nil {
+		return fmt.Errorf("pushing provenance-annotated SOCI index manifest %s/%s: %w", repository, tag, err)
+	}
+	return nil
+}
+
+// linkSubject makes the pushed V2 SOCI index discoverable from its subject
+// image. It stamps the index manifest with a "subject" field pointing at
+// imageDigest, then, if the registry supports the OCI 1.1 Referrers API,
+// relies on that alone; otherwise it falls back to maintaining a tag-based
+// referrers list for OCI 1.0 registries.
+func (w *Writer) linkSubject(ctx context.Context, repository, imageDigest string) error {
+	sociTag, err := sociIndexTag(imageDigest)
+	if err != nil {
+		return err
+	}
+
+	raw, descriptor, err := w.Registry.GetManifestBytes(ctx, repository, sociTag)
+	if err != nil {
+		return fmt.Errorf("fetching SOCI index manifest %s/%s: %w", repository, sociTag, err)
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return fmt.Errorf("parsing SOCI index manifest %s/%s: %w", repository, sociTag, err)
+	}
+
+	subject, err := w.Registry.HeadManifest(ctx, repository, imageDigest)
+	if err != nil {
+		return fmt.Errorf("resolving subject image %s/%s: %w", repository, imageDigest, err)
+	}
+	manifest.Subject = &subject
+
+	rewritten, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("re-encoding SOCI index manifest %s/%s: %w", repository, sociTag, err)
+	}
+
+	pushedDigest, err := w.Registry.PushManifest(ctx, repository, sociTag, descriptor.MediaType, rewritten, false)
+	if err != nil {
+		return fmt.Errorf("pushing subject-linked SOCI index manifest %s/%s: %w", repository, sociTag, err)
+	}
+
+	supportsReferrers, err := w.Registry.SupportsReferrersAPI(ctx, repository, imageDigest)
+	if err != nil {
+		return fmt.Errorf("checking referrers API support for %s/%s: %w", repository, imageDigest, err)
+	}
+	if supportsReferrers {
+		return nil
+	}
+
+	return w.updateReferrersList(ctx, repository, imageDigest, ocispec.Descriptor{
+		MediaType:    manifest.MediaType,
+		Digest:       pushedDigest,
+		Size:         int64(len(rewritten)),
+		ArtifactType: referrerArtifactType(manifest),
+	})
+}
+
+// updateReferrersList maintains the OCI 1.0 fallback for linking a SOCI
+// index to its subject: an image index, tagged "<algo>-<hex>.referrers",
+// whose manifests list mirrors what the OCI 1.1 Referrers API would return
+// for imageDigest. It is a read-modify-write: since stampProvenance gives the
+// SOCI index manifest a fresh digest on every regeneration (new "created"
+// timestamp, new Lambda request-id), entries can't be de-duplicated by
+// digest — that would never match a prior run's entry for the same subject
+// and the list would grow a stale referrer on every re-index. Instead,
+// mergeSOCIReferrer replaces any existing entry stamped with
+// artifactTypeSOCIIndex, leaving referrers other tools (signatures, SBOMs,
+// attestations) added to the same list untouched. A missing list
+// (ErrManifestNotFound) is treated as a fresh start; any other read failure
+// is propagated rather than risking silently dropping every other referrer
+// already recorded there.
+func (w *Writer) updateReferrersList(ctx context.Context, repository, imageDigest string, entry ocispec.Descriptor) error {
+	tag, err := referrersTag(imageDigest)
+	if err != nil {
+		return err
+	}
+
+	var referrers ocispec.Index
+	referrers.SchemaVersion = 2
+	referrers.MediaType = ocispec.MediaTypeImageIndex
+
+	raw, _, err := w.Registry.GetManifestBytes(ctx, repository, tag)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(raw, &referrers); err != nil {
+			return fmt.Errorf("parsing existing referrers list %s/%s: %w", repository, tag, err)
+		}
+	case errors.Is(err, registry.ErrManifestNotFound):
+		// No referrers list yet; start with the one entry being added below.
+	default:
+		return fmt.Errorf("fetching existing referrers list %s/%s: %w", repository, tag, err)
+	}
+
+	referrers.Manifests = mergeSOCIReferrer(referrers.Manifests, entry)
+
+	raw, err = json.Marshal(referrers)
+	if err != nil {
+		return fmt.Errorf("encoding referrers list %s/%s: %w", repository, tag, err)
+	}
+
+	if _, err := w.Registry.PushManifest(ctx, repository, tag, ocispec.MediaTypeImageIndex, raw, false); err != nil {
+		return fmt.Errorf("pushing referrers list %s/%s: %w", repository, tag, err)
+	}
+	return nil
+}
+
+// mergeSOCIReferrer returns existing with any prior entry of artifactType
+// artifactTypeSOCIIndex replaced by entry, leaving every other referrer
+// (e.g. a signature or SBOM some other tool added to the same list)
+// untouched. A subject has at most one current SOCI-index referrer.
+func mergeSOCIReferrer(existing []ocispec.Descriptor, entry ocispec.Descriptor) []ocispec.Descriptor {
+	manifests := make([]ocispec.Descriptor, 0, len(existing)+1)
+	for _, m := range existing {
+		if m.ArtifactType != artifactTypeSOCIIndex {
+			manifests = append(manifests, m)
+		}
+	}
+	return append(manifests, entry)
+}
+
+// referrerArtifactType mirrors the artifactType the OCI 1.1 Referrers API
+// would report for manifest: its own artifactType if set, otherwise its
+// config's media type, per the distribution spec's fallback rule. In
+// practice stampProvenance always sets manifest.ArtifactType to
+// artifactTypeSOCIIndex before this is consulted, so the fallback only
+// matters for a manifest that somehow reached here unstamped.
+func referrerArtifactType(manifest ocispec.Manifest) string {
+	if manifest.ArtifactType != "" {
+		return manifest.ArtifactType
+	}
+	return manifest.Config.MediaType
+}
+
+// referrersTag returns the conventional tag an OCI 1.0 registry's referrers
+// list fallback is stored under for a given subject digest, e.g.
+// "sha256:abcd..." becomes "sha256-abcd....referrers".
+func referrersTag(subjectDigest string) (string, error) {
+	algo, hex, found := strings.Cut(subjectDigest, ":")
+	if !found {
+		return "", fmt.Errorf("malformed subject digest %q", subjectDigest)
+	}
+	return fmt.Sprintf("%s-%s.referrers", algo, hex), nil
+}
+
+// convertPushedIndexToOCI re-fetches the SOCI index manifest the soci CLI
+// just pushed, rewrites any Docker-specific media types to their OCI
+// equivalents, and re-pushes it under its conventional tag. The resulting
+// digest differs from the one the soci CLI computed; it is not returned.
+// linkSubject, which finishPush runs after this, re-fetches the index by that
+// tag, so a referrers entry uses the digest of the converted manifest.
+func (w *Writer) convertPushedIndexToOCI(ctx context.Context, repository, imageDigest string) error {
+	tag, err := sociIndexTag(imageDigest)
+	if err != nil {
+		return err
+	}
+
+	raw, descriptor, err := w.Registry.GetManifestBytes(ctx, repository, tag)
+	if err != nil {
+		return fmt.Errorf("fetching SOCI index manifest %s/%s: %w", repository, tag, err)
+	}
+
+	if _, err := w.Registry.PushManifest(ctx, repository, tag, descriptor.MediaType, raw, true); err != nil {
+		return fmt.Errorf("pushing OCI-converted SOCI index manifest %s/%s: %w", repository, tag, err)
+	}
+
+	return nil
+}
+
+// sociIndexTag returns the conventional tag the soci CLI publishes a SOCI
+// index under for a given image digest, e.g. "sha256:abcd..." becomes
+// "sha256-abcd....soci".
+func sociIndexTag(imageDigest string) (string, error) {
+	algo, hex, found := strings.Cut(imageDigest, ":")
+	if !found {
+		return "", fmt.Errorf("malformed image digest %q", imageDigest)
+	}
+	return fmt.Sprintf("%s-%s.soci", algo, hex), nil
+}
@@ -0,0 +1,128 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package writer
+
+import (
+	"errors"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestIsUnsupportedFlagError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"unknown flag", errors.New("Error: unknown flag: --output"), true},
+		{"unknown shorthand flag", errors.New("unknown shorthand flag: 'o' in -o"), true},
+		{"flag provided but not defined", errors.New("flag provided but not defined: -manifest-file"), true},
+		{"unrecognized flag", errors.New("unrecognized flag '--skip-blobs'"), true},
+		{"unrecognized option", errors.New("unrecognized option '--skip-blobs'"), true},
+		{"mixed case still matches", errors.New("Unknown Flag: --output"), true},
+		{"unrelated build failure", errors.New("failed to pull image: connection refused"), false},
+		{"unrelated push failure", errors.New("push: manifest not found"), false},
+	}
+
+	for _, c := range cases {
+		if got := isUnsupportedFlagError(c.err); got != c.want {
+			t.Errorf("%s: isUnsupportedFlagError(%q) = %v, want %v", c.name, c.err, got, c.want)
+		}
+	}
+}
+
+func TestSociIndexTag(t *testing.T) {
+	tag, err := sociIndexTag("sha256:abcd1234")
+	if err != nil {
+		t.Fatalf("sociIndexTag returned error: %v", err)
+	}
+	if want := "sha256-abcd1234.soci"; tag != want {
+		t.Errorf("sociIndexTag = %q, want %q", tag, want)
+	}
+
+	if _, err := sociIndexTag("sha256abcd1234"); err == nil {
+		t.Error("expected an error for a digest with no algorithm separator, got nil")
+	}
+}
+
+func TestReferrersTag(t *testing.T) {
+	tag, err := referrersTag("sha256:abcd1234")
+	if err != nil {
+		t.Fatalf("referrersTag returned error: %v", err)
+	}
+	if want := "sha256-abcd1234.referrers"; tag != want {
+		t.Errorf("referrersTag = %q, want %q", tag, want)
+	}
+
+	if _, err := referrersTag("sha256abcd1234"); err == nil {
+		t.Error("expected an error for a digest with no algorithm separator, got nil")
+	}
+}
+
+func TestReferrerArtifactType(t *testing.T) {
+	withArtifactType := ocispec.Manifest{ArtifactType: artifactTypeSOCIIndex}
+	if got := referrerArtifactType(withArtifactType); got != artifactTypeSOCIIndex {
+		t.Errorf("referrerArtifactType = %q, want %q", got, artifactTypeSOCIIndex)
+	}
+
+	withoutArtifactType := ocispec.Manifest{
+		Config: ocispec.Descriptor{MediaType: "application/vnd.oci.image.config.v1+json"},
+	}
+	if got := referrerArtifactType(withoutArtifactType); got != withoutArtifactType.Config.MediaType {
+		t.Errorf("referrerArtifactType fallback = %q, want %q", got, withoutArtifactType.Config.MediaType)
+	}
+}
+
+// TestMergeSOCIReferrer asserts the dedup invariant the OCI 1.0 referrers
+// list fallback depends on: a prior SOCI-index entry is dropped and the new
+// one appended, but referrers other tools (signatures, SBOMs) added to the same list are
+// left untouched even though they may share entry's digest-unrelated fields.
+func TestMergeSOCIReferrer(t *testing.T) {
+	signature := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		Digest:       "sha256:sig",
+		ArtifactType: "application/vnd.example.signature.v1+json",
+	}
+	staleSOCI := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		Digest:       "sha256:old-soci",
+		ArtifactType: artifactTypeSOCIIndex,
+	}
+	freshSOCI := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		Digest:       "sha256:new-soci",
+		ArtifactType: artifactTypeSOCIIndex,
+	}
+
+	merged := mergeSOCIReferrer([]ocispec.Descriptor{signature, staleSOCI}, freshSOCI)
+
+	if len(merged) != 2 {
+		t.Fatalf("expected 2 entries after merge, got %d: %+v", len(merged), merged)
+	}
+
+	var sawSignature, sawFresh bool
+	for _, m := range merged {
+		switch m.Digest {
+		case signature.Digest:
+			sawSignature = true
+		case freshSOCI.Digest:
+			sawFresh = true
+		case staleSOCI.Digest:
+			t.Errorf("stale SOCI entry %v should have been replaced", m)
+		}
+	}
+	if !sawSignature {
+		t.Error("non-SOCI referrer (signature) was dropped by merge")
+	}
+	if !sawFresh {
+		t.Error("new SOCI referrer was not added by merge")
+	}
+
+	// A referrer-free list just gets the new entry appended.
+	fromEmpty := mergeSOCIReferrer(nil, freshSOCI)
+	if len(fromEmpty) != 1 || fromEmpty[0].Digest != freshSOCI.Digest {
+		t.Errorf("mergeSOCIReferrer(nil, entry) = %+v, want a single entry matching entry", fromEmpty)
+	}
+}